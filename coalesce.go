@@ -0,0 +1,77 @@
+// +build darwin
+
+package fsevents
+
+import "time"
+
+// Coalesce merges the batches received from in, delivering one batch per
+// window of time. Events for the same Path within a window are merged into
+// one, with their Flags OR'd together and the highest ID kept. A path that
+// is removed and then created again within the window is delivered as two
+// events so the replacement isn't mistaken for a modification, whereas
+// created-then-removed merges to a single event carrying both flags.
+//
+// The returned channel is closed, after delivering any pending events, once
+// in is closed.
+func Coalesce(in <-chan []Event, window time.Duration) <-chan []Event {
+	out := make(chan []Event)
+
+	go func() {
+		defer close(out)
+
+		var (
+			batch []Event
+			index = map[string]int{}
+			flush <-chan time.Time
+		)
+		for {
+			select {
+			case events, ok := <-in:
+				if !ok {
+					if len(batch) > 0 {
+						out <- batch
+					}
+					return
+				}
+				for _, event := range events {
+					batch = coalesceEvent(batch, index, event)
+				}
+				if flush == nil && len(batch) > 0 {
+					flush = time.After(window)
+				}
+			case <-flush:
+				out <- batch
+				batch = nil
+				index = map[string]int{}
+				flush = nil
+			}
+		}
+	}()
+
+	return out
+}
+
+// coalesceEvent merges event into batch, where index maps each path to the
+// position of its latest event in batch.
+func coalesceEvent(batch []Event, index map[string]int, event Event) []Event {
+	i, ok := index[event.Path]
+	if ok && !isRecreate(batch[i], event) {
+		batch[i].Flags |= event.Flags
+		if event.ID > batch[i].ID {
+			batch[i].ID = event.ID
+		}
+		return batch
+	}
+
+	index[event.Path] = len(batch)
+	return append(batch, event)
+}
+
+// isRecreate reports whether event creates the item merged is about again,
+// after its removal. FSEvents flags accumulate for a path, so later events
+// for a recreated item carry ItemCreated and ItemRemoved too; only one
+// without ItemRemoved is taken for a new create.
+func isRecreate(merged, event Event) bool {
+	return merged.Flags&ItemRemoved != 0 &&
+		event.Flags&ItemCreated != 0 && event.Flags&ItemRemoved == 0
+}
@@ -0,0 +1,79 @@
+// +build darwin
+
+package fsevents
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	in := make(chan []Event)
+	out := Coalesce(in, 500*time.Millisecond)
+
+	in <- []Event{
+		{Path: "/a", Flags: ItemCreated | ItemIsFile, ID: 1},
+		{Path: "/b", Flags: ItemModified | ItemIsFile, ID: 2},
+	}
+	in <- []Event{
+		{Path: "/a", Flags: ItemModified | ItemIsFile, ID: 3},
+		{Path: "/b", Flags: ItemModified | ItemIsFile, ID: 4},
+		{Path: "/c", Flags: ItemCreated | ItemIsFile, ID: 5},
+		{Path: "/c", Flags: ItemRemoved | ItemIsFile, ID: 6},
+	}
+
+	want := []Event{
+		{Path: "/a", Flags: ItemCreated | ItemModified | ItemIsFile, ID: 3},
+		{Path: "/b", Flags: ItemModified | ItemIsFile, ID: 4},
+		{Path: "/c", Flags: ItemCreated | ItemRemoved | ItemIsFile, ID: 6},
+	}
+	if got := <-out; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v wanted: %v", got, want)
+	}
+
+	// a removed and recreated path is kept as two events, and pending
+	// events are flushed when in closes
+	in <- []Event{
+		{Path: "/a", Flags: ItemRemoved | ItemIsFile, ID: 7},
+		{Path: "/a", Flags: ItemCreated | ItemIsFile, ID: 8},
+	}
+	close(in)
+
+	want = []Event{
+		{Path: "/a", Flags: ItemRemoved | ItemIsFile, ID: 7},
+		{Path: "/a", Flags: ItemCreated | ItemIsFile, ID: 8},
+	}
+	if got := <-out; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v wanted: %v", got, want)
+	}
+	if _, ok := <-out; ok {
+		t.Error("output channel was not closed")
+	}
+}
+
+func TestCoalesceAccumulatedFlags(t *testing.T) {
+	var (
+		batch []Event
+		index = map[string]int{}
+	)
+	for i, flags := range []EventFlags{
+		ItemCreated,
+		ItemCreated | ItemRemoved,
+		// recreated, then saved repeatedly
+		ItemCreated,
+		ItemCreated | ItemRemoved | ItemModified,
+		ItemCreated | ItemRemoved | ItemModified,
+		ItemCreated | ItemRemoved | ItemModified,
+	} {
+		batch = coalesceEvent(batch, index, Event{Path: "/a", Flags: flags, ID: uint64(i + 1)})
+	}
+
+	want := []Event{
+		{Path: "/a", Flags: ItemCreated | ItemRemoved, ID: 2},
+		{Path: "/a", Flags: ItemCreated | ItemRemoved | ItemModified, ID: 6},
+	}
+	if !reflect.DeepEqual(batch, want) {
+		t.Errorf("got: %v wanted: %v", batch, want)
+	}
+}
@@ -30,7 +30,9 @@ func main() {
 		Latency: 500 * time.Millisecond,
 		Device:  dev,
 		Flags:   fsevents.FileEvents | fsevents.WatchRoot}
-	es.Start()
+	if err := es.Start(); err != nil {
+		log.Fatalf("Failed to start the EventStream: %v", err)
+	}
 	ec := es.Events
 
 	log.Println("Device UUID", fsevents.GetDeviceUUID(dev))
@@ -59,7 +61,9 @@ func main() {
 		log.Print("Stopped, press enter to restart")
 		in.ReadString('\n')
 		es.Resume = true
-		es.Start()
+		if err := es.Start(); err != nil {
+			log.Fatalf("Failed to restart the EventStream: %v", err)
+		}
 
 		log.Print("Restarted, press enter to quit")
 		in.ReadString('\n')
@@ -67,35 +71,6 @@ func main() {
 	}
 }
 
-var noteDescription = map[fsevents.EventFlags]string{
-	fsevents.MustScanSubDirs: "MustScanSubdirs",
-	fsevents.UserDropped:     "UserDropped",
-	fsevents.KernelDropped:   "KernelDropped",
-	fsevents.EventIDsWrapped: "EventIDsWrapped",
-	fsevents.HistoryDone:     "HistoryDone",
-	fsevents.RootChanged:     "RootChanged",
-	fsevents.Mount:           "Mount",
-	fsevents.Unmount:         "Unmount",
-
-	fsevents.ItemCreated:       "Created",
-	fsevents.ItemRemoved:       "Removed",
-	fsevents.ItemInodeMetaMod:  "InodeMetaMod",
-	fsevents.ItemRenamed:       "Renamed",
-	fsevents.ItemModified:      "Modified",
-	fsevents.ItemFinderInfoMod: "FinderInfoMod",
-	fsevents.ItemChangeOwner:   "ChangeOwner",
-	fsevents.ItemXattrMod:      "XAttrMod",
-	fsevents.ItemIsFile:        "IsFile",
-	fsevents.ItemIsDir:         "IsDir",
-	fsevents.ItemIsSymlink:     "IsSymLink",
-}
-
 func logEvent(event fsevents.Event) {
-	note := ""
-	for bit, description := range noteDescription {
-		if event.Flags&bit == bit {
-			note += description + " "
-		}
-	}
-	log.Printf("EventID: %d Path: %s Flags: %s", event.ID, event.Path, note)
+	log.Printf("EventID: %d Path: %s Flags: %s", event.ID, event.Path, event.Flags)
 }
@@ -4,7 +4,15 @@
 package fsevents
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -14,8 +22,9 @@ type CreateFlags uint32
 
 // kFSEventStreamCreateFlag...
 const (
-	// use CoreFoundation types instead of raw C types (disabled)
-	useCFTypes CreateFlags = 1 << iota
+	// UseCFTypes has FSEvents pass event paths as CoreFoundation strings
+	// rather than C strings. Either way they are delivered as Go strings.
+	UseCFTypes CreateFlags = 1 << iota
 
 	// NoDefer sends events on the leading edge (for interactive applications).
 	// By default events are delivered after latency seconds (for background tasks).
@@ -73,6 +82,144 @@ const (
 	ItemIsSymlink
 )
 
+// eventFlagNames are the names of the EventFlags, indexed by bit position.
+var eventFlagNames = [...]string{
+	"MustScanSubDirs",
+	"UserDropped",
+	"KernelDropped",
+	"EventIDsWrapped",
+	"HistoryDone",
+	"RootChanged",
+	"Mount",
+	"Unmount",
+	"ItemCreated",
+	"ItemRemoved",
+	"ItemInodeMetaMod",
+	"ItemRenamed",
+	"ItemModified",
+	"ItemFinderInfoMod",
+	"ItemChangeOwner",
+	"ItemXattrMod",
+	"ItemIsFile",
+	"ItemIsDir",
+	"ItemIsSymlink",
+}
+
+// String renders the set flags separated by "|", e.g. "ItemCreated|ItemIsFile".
+// Bits without a known name are rendered in hex, and no flags as "None".
+func (f EventFlags) String() string {
+	if f == 0 {
+		return "None"
+	}
+
+	var names []string
+	for i, name := range eventFlagNames {
+		bit := EventFlags(1) << uint(i)
+		if f&bit != 0 {
+			names = append(names, name)
+			f &^= bit
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(f)))
+	}
+	return strings.Join(names, "|")
+}
+
+// MustScanSubDirs reports whether the subdirectories of the path need rescanning.
+func (f EventFlags) MustScanSubDirs() bool { return f&MustScanSubDirs != 0 }
+
+// IsDropped reports whether events were dropped in user space or the kernel.
+func (f EventFlags) IsDropped() bool { return f&(UserDropped|KernelDropped) != 0 }
+
+// IsEventIDsWrapped reports whether the event ID counter wrapped around.
+func (f EventFlags) IsEventIDsWrapped() bool { return f&EventIDsWrapped != 0 }
+
+// IsHistoryDone reports whether this is the sentinel ending historical events.
+func (f EventFlags) IsHistoryDone() bool { return f&HistoryDone != 0 }
+
+// IsRootChanged reports whether a directory along the watched path changed.
+func (f EventFlags) IsRootChanged() bool { return f&RootChanged != 0 }
+
+// IsMount reports whether a volume was mounted under the watched path.
+func (f EventFlags) IsMount() bool { return f&Mount != 0 }
+
+// IsUnmount reports whether a volume was unmounted under the watched path.
+func (f EventFlags) IsUnmount() bool { return f&Unmount != 0 }
+
+// IsCreated reports whether the item was created.
+func (f EventFlags) IsCreated() bool { return f&ItemCreated != 0 }
+
+// IsRemoved reports whether the item was removed.
+func (f EventFlags) IsRemoved() bool { return f&ItemRemoved != 0 }
+
+// IsInodeMetaMod reports whether the item's inode metadata was modified.
+func (f EventFlags) IsInodeMetaMod() bool { return f&ItemInodeMetaMod != 0 }
+
+// IsRenamed reports whether the item was renamed.
+func (f EventFlags) IsRenamed() bool { return f&ItemRenamed != 0 }
+
+// IsModified reports whether the item's contents were modified.
+func (f EventFlags) IsModified() bool { return f&ItemModified != 0 }
+
+// IsFinderInfoMod reports whether the item's Finder info was modified.
+func (f EventFlags) IsFinderInfoMod() bool { return f&ItemFinderInfoMod != 0 }
+
+// IsChangeOwner reports whether the item's ownership changed.
+func (f EventFlags) IsChangeOwner() bool { return f&ItemChangeOwner != 0 }
+
+// IsXattrMod reports whether the item's extended attributes were modified.
+func (f EventFlags) IsXattrMod() bool { return f&ItemXattrMod != 0 }
+
+// IsFile reports whether the item is a regular file.
+func (f EventFlags) IsFile() bool { return f&ItemIsFile != 0 }
+
+// IsDir reports whether the item is a directory.
+func (f EventFlags) IsDir() bool { return f&ItemIsDir != 0 }
+
+// IsSymlink reports whether the item is a symbolic link.
+func (f EventFlags) IsSymlink() bool { return f&ItemIsSymlink != 0 }
+
+var (
+	// ErrCreateFailed is returned by Start when FSEvents could not create
+	// the stream, usually due to invalid paths or flags.
+	ErrCreateFailed = errors.New("fsevents: failed to create event stream")
+
+	// ErrStartFailed is returned by Start when the stream was created but
+	// FSEvents refused to start it.
+	ErrStartFailed = errors.New("fsevents: failed to start event stream")
+
+	// ErrAlreadyStarted is returned by Start when the stream is running.
+	ErrAlreadyStarted = errors.New("fsevents: event stream already started")
+
+	// ErrNotStarted is returned when an operation requires a running stream.
+	ErrNotStarted = errors.New("fsevents: event stream not started")
+)
+
+// cfAbsoluteTimeEpoch is the Unix time of the CFAbsoluteTime reference date,
+// 2001-01-01 00:00:00 UTC (kCFAbsoluteTimeIntervalSince1970).
+const cfAbsoluteTimeEpoch = 978307200
+
+// cfAbsoluteTime converts t to a CFAbsoluteTime, which counts seconds from
+// the reference date rather than the Unix epoch.
+func cfAbsoluteTime(t time.Time) float64 {
+	return float64(t.UnixNano())/float64(time.Second) - cfAbsoluteTimeEpoch
+}
+
+// LatestEventIDForDevice returns a checkpoint to later resume a stream
+// relative to the device from. FSEvents takes it from the time index of
+// the device's history, so it is conservative: it can trail the IDs of
+// events already delivered, which resuming from it replays, but no event
+// after it is missed. It is therefore not an upper bound on event IDs; use
+// LatestEventID for that. Pass dev 0 for the host event ID returned by
+// LatestEventID.
+func LatestEventIDForDevice(dev int32) uint64 {
+	if dev == 0 {
+		return LatestEventID()
+	}
+	return EventIDForDeviceBeforeTime(dev, time.Now())
+}
+
 // Event represents a single file system notification.
 type Event struct {
 	Path  string
@@ -89,6 +236,17 @@ func DeviceForPath(path string) (int32, error) {
 	return stat.Dev, nil
 }
 
+// UUIDForDevice returns the UUID identifying the FSEvents history of a device.
+// Store it alongside a resume EventID; if it differs on a later run, the
+// volume was reformatted or replaced and the EventID is no longer valid.
+func UUIDForDevice(dev int32) (string, error) {
+	uuid := GetDeviceUUID(dev)
+	if uuid == "" {
+		return "", fmt.Errorf("fsevents: no UUID for device %d", dev)
+	}
+	return uuid, nil
+}
+
 // EventStream is the primary interface to FSEvents
 // You can provide your own event channel if you wish (or one will be
 // created on Start).
@@ -98,22 +256,156 @@ func DeviceForPath(path string) (int32, error) {
 //   es.Stop()
 //   ...
 type EventStream struct {
+	// EventID is the ID of the last event handed to the consumer, and where
+	// a stream with Resume set picks up from. A stream started from now sets
+	// it to the latest event ID. It is written by the stream while running,
+	// so use LatestEventID to read it. Kept first for 64-bit alignment of
+	// atomic operations on 32-bit platforms.
+	EventID uint64
+
+	mu           sync.Mutex // guards the fields below and Start/Stop
+	started      bool
 	stream       FSEventStreamRef
 	rlref        CFRunLoopRef
+	queue        dispatchQueue
 	hasFinalizer bool
 	registryID   uintptr
 	uuid         string
+	paths        []string      // Paths as passed to FSEvents
+	flags        CreateFlags   // Flags as passed to FSEvents
+	quit         chan struct{} // closed by Stop to abandon pending sends
+	done         chan struct{} // closed once the run loop has exited
+	pending      []Event       // rest of the batch being returned by Next
+	free         chan []Event  // released batches, see ReuseBatches
+	caughtUp     chan struct{} // closed on HistoryDone
+	historyDone  bool          // only used by the callback
+	eventsClosed bool          // Events was closed by StartWithContext
 
-	Events  chan []Event
-	Paths   []string
-	Flags   CreateFlags
-	EventID uint64
-	Resume  bool
+	// ctx is from StartWithContext, and kept across restarts
+	ctx context.Context
+
+	flushing sync.WaitGroup // Flush calls using stream without holding mu
+
+	rewatchMu sync.Mutex // guards rewatch, which the callback also uses
+	rewatch   *time.Timer
+
+	Events chan []Event
+	Paths  []string
+	Flags  CreateFlags
+	Resume bool
+
+	// Latency is how long FSEvents waits to coalesce events before
+	// delivering them. Zero means DefaultLatency; for the lowest latency
+	// set a tiny duration such as time.Millisecond, ideally with NoDefer.
 	Latency time.Duration
+
+	// Device, if non-zero, makes the stream relative to that device. All
+	// Paths must then be on it; Start returns an error naming any path that
+	// isn't, rather than silently missing its events. Watch paths on
+	// several devices with one stream per device, or with Device left 0.
 	// syscall represents this with an int32
 	Device int32
+
+	// VolumeEvents, if non-nil, receives the Mount and Unmount events
+	// instead of Events, with Path set to the mount point. It isn't
+	// subject to Mask, and must be kept drained while the stream runs.
+	VolumeEvents chan Event
+
+	// Wrapped, if non-nil, receives the ID of any event flagged
+	// EventIDsWrapped: the event ID counter wrapped around, so resume points
+	// saved before it are invalid and should be replaced. A stream started
+	// with Resume from such a stale EventID starts from now instead.
+	Wrapped chan uint64
+
+	// Dropped, if non-nil, receives the paths of the events in a batch that
+	// are flagged MustScanSubDirs, before the batch is sent on Events. Such
+	// events mean FSEvents coalesced or dropped events (see UserDropped and
+	// KernelDropped), so the subtrees under these paths must be rescanned.
+	// Like Events, it must be kept drained while the stream is running.
+	Dropped chan []string
+
+	// AllowMissing lets Start watch Paths that don't exist yet, which is
+	// useful together with WatchRoot. They are still logged, and reported
+	// by Validate; Start fails on paths that don't exist otherwise.
+	AllowMissing bool
+
+	// ResolveSymlinks resolves symlinks in Paths when starting the stream.
+	// FSEvents reports events using canonical paths, so on macOS watching
+	// /tmp yields events under /private/tmp; with this set, the paths from
+	// PathsBeingWatched are a prefix of Event.Path. A path that can't be
+	// resolved, e.g. because it doesn't exist yet, is watched as given and
+	// the failure is logged.
+	ResolveSymlinks bool
+
+	// AutoRewatchRoot restarts the stream, resuming from EventID, when a
+	// RootChanged event shows a directory along one of the Paths has moved
+	// or been deleted, once all Paths exist again. Restarts are delayed
+	// until the root has stopped changing for a second. Use with WatchRoot.
+	AutoRewatchRoot bool
+
+	// NormalizePath, if non-nil, rewrites each Event.Path before delivery.
+	// It is meant for Unicode normalization: HFS+ stores names decomposed
+	// (NFD) and so reports them that way, while APFS keeps whichever form a
+	// name was created with, so events can carry either. For names with
+	// accents to compare equal to the NFC form Go programs usually hold, use
+	// norm.NFC.String from golang.org/x/text/unicode/norm; the package
+	// doesn't depend on it itself.
+	NormalizePath func(string) string
+
+	// Mask, if non-zero, drops events that have none of its flags set
+	// before they are sent on Events. Events flagged MustScanSubDirs,
+	// UserDropped, KernelDropped, EventIDsWrapped, HistoryDone or
+	// RootChanged are always delivered, as ignoring them isn't safe.
+	Mask EventFlags
+
+	// BufferSize is the capacity of the Events channel created by Start,
+	// for streams that don't provide their own. Callbacks block while the
+	// channel is full, which stalls FSEvents and risks it dropping events
+	// (see MustScanSubDirs) if the consumer falls behind for long; a buffer
+	// absorbs bursts at the cost of memory and delivery delay.
+	BufferSize int
+
+	// DropOnFull makes the callback drop batches that don't fit on Events
+	// rather than wait for the consumer. The paths of a dropped batch are
+	// sent on Dropped, if there is room, so they can be rescanned. This
+	// keeps FSEvents flowing however slow the consumer is, but loses
+	// events as soon as it falls behind. Sends on the other channels don't
+	// wait either: what doesn't fit on VolumeEvents, Wrapped or Dropped is
+	// logged and dropped.
+	DropOnFull bool
+
+	// ReuseBatches recycles the slices sent on Events to reduce allocations
+	// under heavy load. Each batch must then be handed back with Release
+	// once the consumer is done with it. Not worth it with Next or Each,
+	// which never release batches.
+	ReuseBatches bool
+
+	// Handler, if non-nil, is called with each batch instead of sending it
+	// on Events, saving the hand-off to another goroutine. It runs on the
+	// thread delivering the FSEvents callback, so it must not block: while
+	// it runs no further events are delivered, and FSEvents drops events
+	// (see MustScanSubDirs) once its queue overflows. Nor may it call Stop,
+	// Restart or UpdatePaths, which wait for the callback to return. With
+	// ReuseBatches set the batch is recycled once Handler returns, so it
+	// must not be retained.
+	Handler func([]Event)
+
+	// UseDispatchQueue schedules the stream on a serial dispatch queue
+	// rather than on a run loop with its own goroutine, which is lighter
+	// when running many streams. Event delivery is the same either way.
+	UseDispatchQueue bool
+
+	// ExclusionPaths are not reported on, even though they are below one
+	// of the Paths. At most MaxExclusionPaths may be given (macOS 10.9+).
+	ExclusionPaths []string
 }
 
+// DefaultLatency is the latency of streams that don't set one.
+const DefaultLatency = 100 * time.Millisecond
+
+// MaxExclusionPaths is the most ExclusionPaths FSEvents supports per stream.
+const MaxExclusionPaths = 8
+
 // eventStreamRegistry is a lookup table for EventStream references passed to
 // cgo. In Go 1.6+ passing a Go pointer to a Go pointer to cgo is not allowed.
 // To get around this issue, we pass only an integer.
@@ -149,10 +441,56 @@ func (r *eventStreamRegistry) Delete(i uintptr) {
 }
 
 // Start listening to an event stream.
-func (es *EventStream) Start() {
-	if es.Events == nil {
-		es.Events = make(chan []Event)
+// It returns ErrCreateFailed or ErrStartFailed if the stream could not be
+// set up, in which case no events will be delivered.
+func (es *EventStream) Start() error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.started {
+		// leave the running stream tied to its context, if any
+		return ErrAlreadyStarted
+	}
+	es.ctx = nil
+	return es.startLocked()
+}
+
+func (es *EventStream) startLocked() error {
+	if es.started {
+		return ErrAlreadyStarted
+	}
+	if err := es.checkPaths(); err != nil {
+		return err
+	}
+	if es.BufferSize < 0 {
+		return fmt.Errorf("fsevents: negative buffer size %d", es.BufferSize)
 	}
+	if es.Latency < 0 {
+		return fmt.Errorf("fsevents: negative latency %s", es.Latency)
+	}
+	if len(es.ExclusionPaths) > MaxExclusionPaths {
+		return fmt.Errorf("fsevents: %d exclusion paths given, at most %d are supported",
+			len(es.ExclusionPaths), MaxExclusionPaths)
+	}
+	paths := es.Paths
+	if es.ResolveSymlinks {
+		paths = resolvePaths(paths)
+	}
+	if es.Device != 0 {
+		if err := checkDevice(paths, es.Device); err != nil {
+			return err
+		}
+	}
+	if es.Events == nil || es.eventsClosed {
+		// sending on a closed channel would panic in the callback
+		es.Events = make(chan []Event, es.BufferSize)
+		es.eventsClosed = false
+	}
+	if es.ReuseBatches && es.free == nil {
+		es.free = make(chan []Event, batchPoolSize)
+	}
+	es.caughtUp = make(chan struct{})
+	es.historyDone = false
 
 	// register eventstream in the local registry for later lookup
 	// in C callback
@@ -161,29 +499,712 @@ func (es *EventStream) Start() {
 	if es.Device != 0 {
 		es.uuid = GetDeviceUUID(es.Device)
 	}
-	es.start(es.Paths, cbInfo)
+	if err := es.start(paths, cbInfo); err != nil {
+		registry.Delete(cbInfo)
+		es.registryID = 0
+		return err
+	}
+	es.paths = paths
+	es.started = true
+	if es.ctx != nil {
+		go es.watchContext(es.ctx, es.quit)
+	}
+	return nil
+}
+
+// PathsError is returned by Validate and Start for watch paths that don't
+// exist or aren't files or directories. Each error is an *os.PathError.
+type PathsError []*os.PathError
+
+func (e PathsError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "fsevents: invalid paths: " + strings.Join(msgs, "; ")
+}
+
+var errNotFileOrDir = errors.New("not a file or directory")
+
+// Validate checks that each of Paths exists and is a file, a directory or a
+// symlink, returning a PathsError for those that aren't. FSEvents itself
+// accepts any path, but never reports events for most of these.
+func (es *EventStream) Validate() error {
+	var errs PathsError
+	for _, path := range es.Paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			perr, ok := err.(*os.PathError)
+			if !ok {
+				perr = &os.PathError{Op: "lstat", Path: path, Err: err}
+			}
+			errs = append(errs, perr)
+			continue
+		}
+		if m := fi.Mode(); !m.IsDir() && !m.IsRegular() && m&os.ModeSymlink == 0 {
+			errs = append(errs, &os.PathError{Op: "watch", Path: path, Err: errNotFileOrDir})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkPaths validates Paths before starting the stream, tolerating missing
+// paths with AllowMissing.
+func (es *EventStream) checkPaths() error {
+	err := es.Validate()
+	if err == nil || !es.AllowMissing {
+		return err
+	}
+
+	var invalid PathsError
+	for _, perr := range err.(PathsError) {
+		if os.IsNotExist(perr) {
+			log.Printf("Watching missing path %q", perr.Path)
+		} else {
+			invalid = append(invalid, perr)
+		}
+	}
+	if len(invalid) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+// resolvePaths returns paths with any symlinks resolved. Paths that can't be
+// resolved, for instance because they don't exist yet, are kept as given.
+func resolvePaths(paths []string) []string {
+	resolved := make([]string, len(paths))
+	for i, path := range paths {
+		p, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			log.Printf("Not resolving symlinks in %q: %s", path, err)
+			p = path
+		}
+		resolved[i] = p
+	}
+	return resolved
+}
+
+// checkDevice returns an error for the first of paths on a device other
+// than dev. Symlinks are followed, as FSEvents watches their targets. Paths
+// that can't be stat'ed are left for FSEvents to deal with.
+func checkDevice(paths []string, dev int32) error {
+	for _, path := range paths {
+		stat := syscall.Stat_t{}
+		if err := syscall.Stat(path, &stat); err == nil && stat.Dev != dev {
+			return fmt.Errorf("fsevents: path %q is on device %d, not %d", path, stat.Dev, dev)
+		}
+	}
+	return nil
+}
+
+// Clone returns a stream with the same configuration, which can be started
+// independently. Its Events and the other channels are left nil, so they
+// aren't shared with es, and so are all the internals of a running stream.
+// Persisted state such as EventID is copied.
+func (es *EventStream) Clone() *EventStream {
+	return &EventStream{
+		EventID:          es.LatestEventID(),
+		Paths:            append([]string(nil), es.Paths...),
+		Flags:            es.Flags,
+		Resume:           es.Resume,
+		Latency:          es.Latency,
+		Device:           es.Device,
+		AllowMissing:     es.AllowMissing,
+		ResolveSymlinks:  es.ResolveSymlinks,
+		AutoRewatchRoot:  es.AutoRewatchRoot,
+		NormalizePath:    es.NormalizePath,
+		Mask:             es.Mask,
+		BufferSize:       es.BufferSize,
+		DropOnFull:       es.DropOnFull,
+		ReuseBatches:     es.ReuseBatches,
+		Handler:          es.Handler,
+		UseDispatchQueue: es.UseDispatchQueue,
+		ExclusionPaths:   append([]string(nil), es.ExclusionPaths...),
+	}
+}
+
+// StartWithContext is like Start, but the stream is stopped automatically
+// when ctx is done. Once the stream has been torn down the Events channel is
+// closed, so a range over it terminates.
+//
+// The stream stays tied to ctx when it is replaced by Restart, UpdatePaths
+// or AutoRewatchRoot; if it can't be started again, Events is closed too.
+// Calling Stop detaches the stream from ctx; cancelling ctx afterwards has
+// no effect and Events is left open. A stream whose Events was closed this
+// way gets a new Events channel when started again.
+func (es *EventStream) StartWithContext(ctx context.Context) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.started {
+		return ErrAlreadyStarted
+	}
+	es.ctx = ctx
+	if err := es.startLocked(); err != nil {
+		es.ctx = nil
+		return err
+	}
+	return nil
+}
+
+// watchContext stops the run of the stream that quit belongs to once ctx is
+// done. A restart ends the run, and starts watching ctx for the next one.
+func (es *EventStream) watchContext(ctx context.Context, quit chan struct{}) {
+	select {
+	case <-ctx.Done():
+		es.mu.Lock()
+		defer es.mu.Unlock()
+		// Stop or a restart may have raced with the cancellation
+		if es.quit == quit && es.stopLocked() {
+			es.detachContext()
+		}
+	case <-quit:
+	}
+}
+
+// detachContext ends the run of a stream tied to a context by closing
+// Events, once the stream has stopped for good: because the context is
+// done, or because a restart failed and nothing is left to watch it.
+func (es *EventStream) detachContext() {
+	if es.ctx == nil {
+		return
+	}
+	es.ctx = nil
+	close(es.Events)
+	es.eventsClosed = true
+}
+
+// EffectiveLatency returns the latency the stream is started with, which is
+// DefaultLatency unless Latency is set.
+func (es *EventStream) EffectiveLatency() time.Duration {
+	if es.Latency == 0 {
+		return DefaultLatency
+	}
+	return es.Latency
+}
+
+// LatestEventID returns the ID of the last event handed to the consumer,
+// which can be persisted as a resume point. Unlike reading EventID directly, it is
+// safe to call while the stream is running.
+func (es *EventStream) LatestEventID() uint64 {
+	return atomic.LoadUint64(&es.EventID)
+}
+
+// PathsBeingWatched returns the paths the running stream is watching, as
+// reported by FSEvents. They can differ from Paths, for example once
+// relative paths and symlinks have been resolved. It returns an empty slice
+// if the stream isn't running.
+func (es *EventStream) PathsBeingWatched() []string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if !es.started {
+		return []string{}
+	}
+	return GetStreamRefPaths(es.stream)
+}
+
+// ResolvedPaths returns the paths the running stream was started with, as
+// passed to FSEvents: Paths with symlinks resolved if ResolveSymlinks is
+// set. A path that couldn't be resolved is the same as in Paths, and the
+// reason was logged. It returns an empty slice if the stream isn't running.
+func (es *EventStream) ResolvedPaths() []string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if !es.started {
+		return []string{}
+	}
+	return append([]string(nil), es.paths...)
+}
+
+// Next returns the events from Events one at a time instead of in batches.
+// It blocks until an event is available, and reports false once Events has
+// been closed and all events received before that have been returned.
+// Next is not safe for concurrent use, nor to mix with receiving from Events.
+func (es *EventStream) Next() (Event, bool) {
+	for len(es.pending) == 0 {
+		batch, ok := <-es.Events
+		if !ok {
+			return Event{}, false
+		}
+		es.pending = batch
+	}
+
+	event := es.pending[0]
+	es.pending = es.pending[1:]
+	return event, true
+}
+
+// Each calls fn with every event returned by Next, until fn returns false
+// or Events is closed.
+func (es *EventStream) Each(fn func(Event) bool) {
+	for {
+		event, ok := es.Next()
+		if !ok || !fn(event) {
+			return
+		}
+	}
+}
+
+// deliver hands a batch of events to the consumer. It is called from the
+// FSEvents callback and gives up on the batch if the stream is stopped
+// while the consumer isn't reading.
+func (es *EventStream) deliver(events []Event) {
+	if es.NormalizePath != nil {
+		for i := range events {
+			events[i].Path = es.NormalizePath(events[i].Path)
+		}
+	}
+
+	var (
+		seen EventFlags
+		last uint64
+	)
+	for _, event := range events {
+		seen |= event.Flags
+		if event.ID > last {
+			last = event.ID
+		}
+		if event.Flags&EventIDsWrapped != 0 {
+			es.wrapped(event.ID)
+		}
+	}
+
+	if seen&HistoryDone != 0 && !es.historyDone {
+		// once the batch with the sentinel has been handed over
+		es.historyDone = true
+		defer close(es.caughtUp)
+	}
+
+	if es.AutoRewatchRoot && seen&RootChanged != 0 {
+		es.scheduleRewatch()
+	}
+
+	if es.Dropped != nil {
+		if paths := rescanPaths(events); len(paths) > 0 {
+			es.sendDropped(paths)
+		}
+	}
+
+	if es.VolumeEvents != nil {
+		events = es.routeVolumeEvents(events)
+	}
+	if es.Mask != 0 {
+		events = filterEvents(events, es.Mask)
+	}
+	if len(events) == 0 {
+		es.Release(events)
+		es.handedOver(last)
+		return
+	}
+
+	if es.Handler != nil {
+		es.Handler(events)
+		es.Release(events)
+		es.handedOver(last)
+		return
+	}
+
+	if es.DropOnFull {
+		select {
+		case es.Events <- events:
+		default:
+			es.overflow(events)
+		}
+		es.handedOver(last)
+		return
+	}
+
+	select {
+	case es.Events <- events:
+		es.advance(last)
+	case <-es.quit:
+		es.Release(events)
+	}
+}
+
+// handedOver moves EventID past a batch that was delivered, or deliberately
+// dropped. Once Stop has been called one of the sends for the batch may have
+// been abandoned, so it is left for the restarted stream to deliver again.
+func (es *EventStream) handedOver(id uint64) {
+	select {
+	case <-es.quit:
+	default:
+		es.advance(id)
+	}
+}
+
+// advance moves EventID forward to id. It is never moved back, nor to the
+// ID 0 of e.g. RootChanged events, which would make a resume replay all of
+// history. Only the callback writes EventID while the stream runs.
+func (es *EventStream) advance(id uint64) {
+	if id > atomic.LoadUint64(&es.EventID) {
+		atomic.StoreUint64(&es.EventID, id)
+	}
+}
+
+// overflow drops a batch there was no room for on Events, signalling its
+// paths on Dropped for rescanning if that doesn't block either.
+func (es *EventStream) overflow(events []Event) {
+	paths := make([]string, len(events))
+	for i, event := range events {
+		paths[i] = event.Path
+	}
+	es.Release(events)
+
+	select {
+	case es.Dropped <- paths:
+	default:
+		log.Printf("Events channel full, dropped %d events", len(paths))
+	}
+}
+
+// routeVolumeEvents sends the Mount and Unmount events on VolumeEvents,
+// returning the remaining events in the storage of events.
+func (es *EventStream) routeVolumeEvents(events []Event) []Event {
+	rest := events[:0]
+	for _, event := range events {
+		if event.Flags&(Mount|Unmount) == 0 {
+			rest = append(rest, event)
+			continue
+		}
+		if es.DropOnFull {
+			select {
+			case es.VolumeEvents <- event:
+			default:
+				log.Printf("VolumeEvents channel full, dropped event for %q", event.Path)
+			}
+			continue
+		}
+		select {
+		case es.VolumeEvents <- event:
+		case <-es.quit:
+		}
+	}
+	return rest
+}
+
+// wrapped reports that the event ID counter wrapped around at event id.
+func (es *EventStream) wrapped(id uint64) {
+	log.Printf("Event IDs wrapped at event %d, earlier events can't be resumed from", id)
+	if es.Wrapped == nil {
+		return
+	}
+	if es.DropOnFull {
+		select {
+		case es.Wrapped <- id:
+		default:
+			log.Printf("Wrapped channel full, dropped event %d", id)
+		}
+		return
+	}
+	select {
+	case es.Wrapped <- id:
+	case <-es.quit:
+	}
+}
+
+// sendDropped sends paths to rescan on Dropped.
+func (es *EventStream) sendDropped(paths []string) {
+	if es.DropOnFull {
+		select {
+		case es.Dropped <- paths:
+		default:
+			log.Printf("Dropped channel full, %d paths to rescan were dropped", len(paths))
+		}
+		return
+	}
+	select {
+	case es.Dropped <- paths:
+	case <-es.quit:
+	}
+}
+
+// rescanPaths returns the paths of the events flagged MustScanSubDirs.
+func rescanPaths(events []Event) []string {
+	var paths []string
+	for _, event := range events {
+		if event.Flags&MustScanSubDirs != 0 {
+			paths = append(paths, event.Path)
+		}
+	}
+	return paths
+}
+
+// batchPoolSize is how many released batches a stream keeps for reuse.
+const batchPoolSize = 16
+
+// newBatch returns a batch for n events, reusing a released one if possible.
+func (es *EventStream) newBatch(n int) []Event {
+	if es.ReuseBatches {
+		select {
+		case batch := <-es.free:
+			if cap(batch) >= n {
+				return batch[:n]
+			}
+		default:
+		}
+	}
+	return make([]Event, n)
+}
+
+// Release returns a batch received from Events to a stream with
+// ReuseBatches set, so the next callback can fill it instead of allocating.
+// Neither the batch nor its events may be used after releasing it.
+// Release does nothing for streams without ReuseBatches.
+func (es *EventStream) Release(events []Event) {
+	if !es.ReuseBatches {
+		return
+	}
+	select {
+	case es.free <- events[:0]:
+	default:
+	}
+}
+
+// alwaysDelivered are the flags that pass any Mask.
+const alwaysDelivered = MustScanSubDirs | UserDropped | KernelDropped |
+	EventIDsWrapped | HistoryDone | RootChanged
+
+// filterEvents keeps the events with a flag in mask, reusing the storage of
+// events.
+func filterEvents(events []Event, mask EventFlags) []Event {
+	mask |= alwaysDelivered
+	kept := events[:0]
+	for _, event := range events {
+		if event.Flags&mask != 0 {
+			kept = append(kept, event)
+		}
+	}
+	return kept
 }
 
 // Flush events that have occurred but haven't been delivered.
-func (es *EventStream) Flush(sync bool) {
-	flush(es.stream, sync)
+// It returns the ID of the last event flushed, which makes a resume point
+// that covers everything up to the flush. With sync set, Flush returns once
+// the flushed events have been handed to the consumer, so it must not be
+// called from the goroutine receiving from Events. A Stop meanwhile makes
+// it return early, without the remaining events being delivered.
+// It returns ErrNotStarted if the stream isn't running.
+func (es *EventStream) Flush(sync bool) (uint64, error) {
+	es.mu.Lock()
+	if !es.started {
+		es.mu.Unlock()
+		return 0, ErrNotStarted
+	}
+	if !sync {
+		defer es.mu.Unlock()
+		return flush(es.stream, false), nil
+	}
+
+	// Waiting for the consumer with mu held would block Stop, and any
+	// method the consumer calls, so instead pin the stream until done.
+	stream := es.stream
+	es.flushing.Add(1)
+	es.mu.Unlock()
+	defer es.flushing.Done()
+
+	return flush(stream, true), nil
 }
 
 // Stop listening to the event stream.
+// Stopping a stream that isn't running is a no-op.
 func (es *EventStream) Stop() {
-	if es.stream != nil {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	es.rewatchMu.Lock()
+	if es.rewatch != nil {
+		es.rewatch.Stop()
+	}
+	es.rewatchMu.Unlock()
+
+	es.ctx = nil
+	es.stopLocked()
+}
+
+// stopLocked tears down a running stream, reporting whether there was one.
+func (es *EventStream) stopLocked() bool {
+	if !es.started {
+		return false
+	}
+
+	close(es.quit)
+	// the callback gives up on the consumer now, letting Flush return
+	es.flushing.Wait()
+	if es.queue != nil {
+		stopQueue(es.stream, es.queue)
+		es.queue = nil
+		close(es.done)
+	} else {
 		stop(es.stream, es.rlref)
-		es.stream = nil
 	}
+	<-es.done
+	es.stream = nil
+	es.paths = nil
+	es.started = false
 
 	// Remove eventstream from the registry
 	registry.Delete(es.registryID)
 	es.registryID = 0
+	return true
+}
+
+// Done returns a channel that is closed once the stream's current run has
+// been torn down. After that nothing more is sent on Events, or on any other
+// channel of the stream, until it is started again, so they can be closed
+// safely. Stop returns only once this has happened; Done is for waiting on
+// a stop made elsewhere, e.g. by StartWithContext. If the stream has never
+// been started the returned channel is already closed.
+func (es *EventStream) Done() <-chan struct{} {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.done == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return es.done
+}
+
+// CaughtUp returns a channel that is closed when a stream started with Resume
+// has delivered all past events up to now, and is moving on to live events;
+// that is, after the batch with the HistoryDone event has been sent on
+// Events. The channel is never closed for streams that aren't resuming.
+func (es *EventStream) CaughtUp() <-chan struct{} {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	return es.caughtUp
+}
+
+// Running reports whether the stream has been started and not stopped since.
+// A concurrent Restart or UpdatePaths completes before Running returns, so
+// the brief stop while the stream is replaced is never observed.
+func (es *EventStream) Running() bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	return es.started
 }
 
 // Restart listening.
-func (es *EventStream) Restart() {
-	es.Stop()
+// It returns ErrNotStarted if the stream isn't running.
+func (es *EventStream) Restart() error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if !es.started {
+		return ErrNotStarted
+	}
+	return es.restartLocked()
+}
+
+func (es *EventStream) restartLocked() error {
+	es.stopLocked()
+	es.Resume = true
+	if err := es.startLocked(); err != nil {
+		es.detachContext()
+		return err
+	}
+	return nil
+}
+
+// rewatchDelay is how long RootChanged events must settle for before
+// AutoRewatchRoot restarts the stream.
+const rewatchDelay = time.Second
+
+// scheduleRewatch restarts the stream once no RootChanged event has been
+// seen for rewatchDelay, so a flapping root doesn't cause a restart storm.
+func (es *EventStream) scheduleRewatch() {
+	es.rewatchMu.Lock()
+	defer es.rewatchMu.Unlock()
+
+	if es.rewatch != nil {
+		es.rewatch.Reset(rewatchDelay)
+		return
+	}
+	es.rewatch = time.AfterFunc(rewatchDelay, es.rewatchRoot)
+}
+
+// rewatchRoot restarts the stream, if it is still running, once all of its
+// paths are back. Until then it waits for the next RootChanged event.
+func (es *EventStream) rewatchRoot() {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if !es.started {
+		return
+	}
+	for _, path := range es.Paths {
+		if _, err := os.Stat(path); err != nil {
+			log.Printf("Root changed, waiting for %q to reappear: %s", path, err)
+			return
+		}
+	}
+
+	log.Printf("Root changed, rewatching %q", es.Paths)
+	if err := es.restartLocked(); err != nil {
+		log.Printf("Error rewatching %q: %s", es.Paths, err)
+	}
+}
+
+// UpdatePaths changes the paths being watched. FSEvents can't change the
+// paths of a running stream, so it is replaced by a new stream that resumes
+// from the last event delivered, and no events are lost for paths watched by
+// both. Newly added paths only report events from that point on. The same
+// Events channel keeps being used. If the stream isn't running, Paths is
+// simply replaced.
+func (es *EventStream) UpdatePaths(paths []string) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if !es.started {
+		es.Paths = paths
+		return nil
+	}
+
+	es.stopLocked()
 	es.Resume = true
-	es.Start()
+
+	old := es.Paths
+	es.Paths = paths
+	if err := es.startLocked(); err != nil {
+		// carry on watching what we were
+		es.Paths = old
+		if rerr := es.startLocked(); rerr != nil {
+			log.Printf("failed to restore paths %q: %s", old, rerr)
+			es.detachContext()
+		}
+		return err
+	}
+	return nil
+}
+
+// sinceEventID returns the event ID to start the stream from. A resume point
+// past the latest event was recorded before event IDs wrapped around (or on
+// another volume), so resuming from it would miss events. Event IDs are
+// system-wide, so this holds for streams relative to a Device too; the
+// per-device IDs of LatestEventIDForDevice can trail events already seen.
+func (es *EventStream) sinceEventID() uint64 {
+	if !es.Resume {
+		// only later events are delivered, so a restart resumes from here
+		atomic.StoreUint64(&es.EventID, LatestEventID())
+		return eventIDSinceNow
+	}
+
+	id := atomic.LoadUint64(&es.EventID)
+	if latest := LatestEventID(); id > latest {
+		log.Printf("Not resuming from event %d, which is past the latest event %d", id, latest)
+		atomic.StoreUint64(&es.EventID, latest)
+		return eventIDSinceNow
+	}
+	return id
 }
@@ -3,9 +3,12 @@
 package fsevents
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -29,7 +32,10 @@ func TestBasicExample(t *testing.T) {
 		Flags:   FileEvents,
 	}
 
-	es.Start()
+	err = es.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	wait := make(chan Event)
 	go func() {
@@ -50,3 +56,1133 @@ func TestBasicExample(t *testing.T) {
 
 	<-wait
 }
+
+func TestStartWithContext(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	es := &EventStream{
+		Paths:   []string{path},
+		Latency: 500 * time.Millisecond,
+		Flags:   FileEvents,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := es.StartWithContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		for range es.Events {
+		}
+		close(closed)
+	}()
+
+	cancel()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Events was not closed after the context was cancelled")
+	}
+
+	// stopping an already torn down stream is a no-op
+	es.Stop()
+
+	// the closed Events must not be reused
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	select {
+	case _, ok := <-es.Events:
+		if !ok {
+			t.Fatal("restarted with the closed Events channel")
+		}
+	default:
+	}
+}
+
+func TestStartWithContextRestart(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	es := &EventStream{
+		Paths:   []string{path},
+		Latency: 500 * time.Millisecond,
+		Flags:   FileEvents,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := es.StartWithContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	// neither may detach the running stream from ctx
+	if err := es.Start(); err != ErrAlreadyStarted {
+		t.Errorf("Start while running: got %v wanted %v", err, ErrAlreadyStarted)
+	}
+	if err := es.StartWithContext(context.Background()); err != ErrAlreadyStarted {
+		t.Errorf("StartWithContext while running: got %v wanted %v", err, ErrAlreadyStarted)
+	}
+
+	// as AutoRewatchRoot and UpdatePaths do
+	if err := es.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		for range es.Events {
+		}
+		close(closed)
+	}()
+
+	cancel()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Events was not closed after the context was cancelled")
+	}
+	if es.Running() {
+		t.Error("stream still running after the context was cancelled")
+	}
+}
+
+func TestStartWithContextRestartFails(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	es := &EventStream{
+		Paths:   []string{path},
+		Latency: 500 * time.Millisecond,
+		Flags:   FileEvents,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := es.StartWithContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	// the watched path is gone, so the stream can't be started again
+	os.RemoveAll(path)
+	if err := es.Restart(); err == nil {
+		t.Fatal("Restart succeeded without the watched path")
+	}
+
+	select {
+	case _, ok := <-es.Events:
+		if ok {
+			t.Error("got an event, wanted Events closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Events was not closed after the restart failed")
+	}
+}
+
+func TestStopIdempotent(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	es := &EventStream{
+		Paths:   []string{path},
+		Latency: 500 * time.Millisecond,
+		Flags:   FileEvents,
+	}
+
+	// none of these may touch the nil stream
+	es.Stop()
+	if _, err := es.Flush(false); err != ErrNotStarted {
+		t.Errorf("Flush before Start: got %v wanted %v", err, ErrNotStarted)
+	}
+	if err := es.Restart(); err != ErrNotStarted {
+		t.Errorf("Restart before Start: got %v wanted %v", err, ErrNotStarted)
+	}
+
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.Start(); err != ErrAlreadyStarted {
+		t.Errorf("second Start: got %v wanted %v", err, ErrAlreadyStarted)
+	}
+	if _, err := es.Flush(false); err != nil {
+		t.Errorf("Flush while running: %v", err)
+	}
+	es.Stop()
+	es.Stop()
+
+	if _, err := es.Flush(true); err != ErrNotStarted {
+		t.Errorf("Flush after Stop: got %v wanted %v", err, ErrNotStarted)
+	}
+}
+
+func TestEventFlagsString(t *testing.T) {
+	tests := []struct {
+		flags EventFlags
+		want  string
+	}{
+		{0, "None"},
+		{ItemCreated, "ItemCreated"},
+		{ItemCreated | ItemIsFile, "ItemCreated|ItemIsFile"},
+		{MustScanSubDirs | KernelDropped, "MustScanSubDirs|KernelDropped"},
+		{ItemRemoved | 1<<30, "ItemRemoved|0x40000000"},
+	}
+	for _, tt := range tests {
+		if got := tt.flags.String(); got != tt.want {
+			t.Errorf("%#x: got: %s wanted: %s", uint32(tt.flags), got, tt.want)
+		}
+	}
+}
+
+func TestEventFlagsPredicates(t *testing.T) {
+	f := ItemRenamed | ItemIsDir
+	if !f.IsRenamed() || !f.IsDir() {
+		t.Errorf("%s: expected IsRenamed and IsDir", f)
+	}
+	if f.IsCreated() || f.IsFile() || f.MustScanSubDirs() {
+		t.Errorf("%s: unexpected IsCreated, IsFile or MustScanSubDirs", f)
+	}
+	if !(MustScanSubDirs | UserDropped).IsDropped() {
+		t.Error("UserDropped should report IsDropped")
+	}
+}
+
+func TestExclusionPaths(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	es := &EventStream{
+		Paths:   []string{path},
+		Latency: 500 * time.Millisecond,
+		Flags:   FileEvents,
+	}
+	for i := 0; i <= MaxExclusionPaths; i++ {
+		es.ExclusionPaths = append(es.ExclusionPaths, filepath.Join(path, fmt.Sprint(i)))
+	}
+	if err := es.Start(); err == nil {
+		es.Stop()
+		t.Fatalf("Start succeeded with %d exclusion paths", len(es.ExclusionPaths))
+	}
+
+	es.ExclusionPaths = es.ExclusionPaths[:MaxExclusionPaths]
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	es.Stop()
+}
+
+func TestUUIDForDevice(t *testing.T) {
+	dev, err := DeviceForPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uuid, err := UUIDForDevice(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := GetDeviceUUID(dev); uuid != e {
+		t.Errorf("got: %s wanted: %s", uuid, e)
+	}
+}
+
+func TestDispatchQueue(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	es := &EventStream{
+		Paths:            []string{path},
+		Latency:          500 * time.Millisecond,
+		Flags:            FileEvents,
+		UseDispatchQueue: true,
+	}
+
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	err = ioutil.WriteFile(filepath.Join(path, "example.txt"), []byte("example"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-es.Events:
+		if len(msg) == 0 {
+			t.Error("received an empty batch")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+}
+
+func TestPathsBeingWatched(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	es := &EventStream{
+		Paths:   []string{path},
+		Latency: 500 * time.Millisecond,
+	}
+	if paths := es.PathsBeingWatched(); paths == nil || len(paths) != 0 {
+		t.Errorf("before Start got: %q wanted an empty slice", paths)
+	}
+
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	if e := 1; len(es.PathsBeingWatched()) != e {
+		t.Errorf("got: %q wanted %d path", es.PathsBeingWatched(), e)
+	}
+}
+
+func TestFilterEvents(t *testing.T) {
+	events := []Event{
+		{Path: "/a", Flags: ItemCreated | ItemIsFile},
+		{Path: "/b", Flags: ItemXattrMod | ItemIsFile},
+		{Path: "/c", Flags: ItemInodeMetaMod | ItemIsDir},
+		{Path: "/d", Flags: MustScanSubDirs | UserDropped},
+		{Path: "/e", Flags: ItemRemoved | ItemIsFile},
+	}
+
+	got := filterEvents(events, ItemCreated|ItemRemoved)
+	want := []string{"/a", "/d", "/e"}
+	if len(got) != len(want) {
+		t.Fatalf("got: %v wanted paths: %q", got, want)
+	}
+	for i := range want {
+		if got[i].Path != want[i] {
+			t.Errorf("pos %d got: %s wanted: %s", i, got[i].Path, want[i])
+		}
+	}
+}
+
+func TestCFAbsoluteTime(t *testing.T) {
+	ref := time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if got := cfAbsoluteTime(ref); got != 0 {
+		t.Errorf("reference date got: %f wanted: 0", got)
+	}
+	if got, e := cfAbsoluteTime(ref.Add(90*time.Second+time.Second/2)), 90.5; got != e {
+		t.Errorf("got: %f wanted: %f", got, e)
+	}
+}
+
+func TestDeviceMismatch(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	dev, err := DeviceForPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// /dev is a separate devfs volume on macOS
+	other, err := DeviceForPath("/dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev == other {
+		t.Skip("no second device available")
+	}
+
+	es := &EventStream{
+		Paths:   []string{path, "/dev"},
+		Latency: 500 * time.Millisecond,
+		Device:  dev,
+	}
+	if err := es.Start(); err == nil {
+		es.Stop()
+		t.Fatal("Start succeeded with paths on different devices")
+	}
+
+	// a symlink on the device pointing to another one is just as wrong
+	link := filepath.Join(path, "dev")
+	if err := os.Symlink("/dev", link); err != nil {
+		t.Fatal(err)
+	}
+	es.Paths = []string{link}
+	if err := es.Start(); err == nil {
+		es.Stop()
+		t.Fatal("Start succeeded with a symlink to a different device")
+	}
+}
+
+func TestNext(t *testing.T) {
+	es := &EventStream{Events: make(chan []Event, 3)}
+	es.Events <- []Event{{Path: "/a"}, {Path: "/b"}}
+	es.Events <- []Event{}
+	es.Events <- []Event{{Path: "/c"}}
+	close(es.Events)
+
+	var paths []string
+	es.Each(func(event Event) bool {
+		paths = append(paths, event.Path)
+		return event.Path != "/b"
+	})
+	if e := "/a /b"; strings.Join(paths, " ") != e {
+		t.Errorf("Each got: %q wanted: %s", paths, e)
+	}
+
+	// the rest of the stream is still there after Each stops early
+	if event, ok := es.Next(); !ok || event.Path != "/c" {
+		t.Errorf("got: %v, %t wanted: /c, true", event, ok)
+	}
+	if _, ok := es.Next(); ok {
+		t.Error("Next returned an event after Events was closed")
+	}
+}
+
+func TestUpdatePaths(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	added, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(added)
+
+	es := &EventStream{
+		Paths:   []string{path},
+		Latency: 500 * time.Millisecond,
+		Flags:   FileEvents,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	events := es.Events
+
+	if err := es.UpdatePaths([]string{path, added}); err != nil {
+		t.Fatal(err)
+	}
+	if es.Events != events {
+		t.Error("Events channel was replaced")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(added, "example.txt"), []byte("example"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-es.Events:
+			for _, event := range msg {
+				if filepath.Base(event.Path) == "example.txt" {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for an event on the added path")
+		}
+	}
+}
+
+func TestRunning(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	es := &EventStream{
+		Paths:   []string{path},
+		Latency: 500 * time.Millisecond,
+	}
+	if es.Running() {
+		t.Error("running before Start")
+	}
+
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !es.Running() {
+		t.Error("not running after Start")
+	}
+	if err := es.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if !es.Running() {
+		t.Error("not running after Restart")
+	}
+
+	es.Stop()
+	if es.Running() {
+		t.Error("running after Stop")
+	}
+}
+
+func benchmarkBatches(b *testing.B, reuse bool) {
+	es := &EventStream{ReuseBatches: reuse, free: make(chan []Event, batchPoolSize)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		// a burst of events, as filled in by the callback
+		batch := es.newBatch(1000)
+		for j := range batch {
+			batch[j] = Event{Path: "/tmp/example.txt", Flags: ItemModified, ID: uint64(j)}
+		}
+		es.Release(batch)
+	}
+}
+
+func BenchmarkBatchAlloc(b *testing.B) { benchmarkBatches(b, false) }
+func BenchmarkBatchReuse(b *testing.B) { benchmarkBatches(b, true) }
+
+func TestResolvePaths(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	// the temp dir can itself be behind a symlink, like /var on macOS
+	dir, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(path, "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(path, "missing")
+
+	got := resolvePaths([]string{link, missing})
+	if got[0] != dir {
+		t.Errorf("got: %s wanted: %s", got[0], dir)
+	}
+	if got[1] != missing {
+		t.Errorf("unresolvable path got: %s wanted: %s", got[1], missing)
+	}
+
+	es := &EventStream{
+		Paths:           []string{link, missing},
+		Latency:         500 * time.Millisecond,
+		AllowMissing:    true,
+		ResolveSymlinks: true,
+	}
+	if paths := es.ResolvedPaths(); paths == nil || len(paths) != 0 {
+		t.Errorf("before Start got: %q wanted an empty slice", paths)
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	if paths := es.ResolvedPaths(); len(paths) != 2 || paths[0] != dir || paths[1] != missing {
+		t.Errorf("got: %q wanted: %q", paths, []string{dir, missing})
+	}
+}
+
+func TestDropped(t *testing.T) {
+	es := &EventStream{
+		Events:  make(chan []Event, 1),
+		Dropped: make(chan []string, 1),
+	}
+	es.deliver([]Event{
+		{Path: "/a", Flags: ItemCreated},
+		{Path: "/b", Flags: MustScanSubDirs | KernelDropped},
+	})
+
+	select {
+	case paths := <-es.Dropped:
+		if len(paths) != 1 || paths[0] != "/b" {
+			t.Errorf("got: %q wanted: [/b]", paths)
+		}
+	default:
+		t.Fatal("no signal on Dropped")
+	}
+	if msg := <-es.Events; len(msg) != 2 {
+		t.Errorf("got %d events, wanted the whole batch", len(msg))
+	}
+
+	es.deliver([]Event{{Path: "/a", Flags: ItemRemoved}})
+	<-es.Events
+	select {
+	case paths := <-es.Dropped:
+		t.Errorf("unexpected signal %q on Dropped", paths)
+	default:
+	}
+}
+
+func TestAutoRewatchRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "root")
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	es := &EventStream{
+		Paths:           []string{path},
+		Latency:         100 * time.Millisecond,
+		Flags:           FileEvents | WatchRoot,
+		AutoRewatchRoot: true,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(10 * time.Second)
+	rootChanged := false
+	for !rootChanged {
+		select {
+		case msg := <-es.Events:
+			for _, event := range msg {
+				rootChanged = rootChanged || event.Flags.IsRootChanged()
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for RootChanged")
+		}
+	}
+
+	// events keep arriving for the new directory after the rewatch
+	time.Sleep(2 * rewatchDelay)
+	err = ioutil.WriteFile(filepath.Join(path, "example.txt"), []byte("example"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case msg := <-es.Events:
+			for _, event := range msg {
+				if filepath.Base(event.Path) == "example.txt" {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for an event after the rewatch")
+		}
+	}
+}
+
+func TestLatency(t *testing.T) {
+	es := &EventStream{Paths: []string{"/"}}
+	if e := DefaultLatency; es.EffectiveLatency() != e {
+		t.Errorf("got: %s wanted: %s", es.EffectiveLatency(), e)
+	}
+	es.Latency = time.Second
+	if e := time.Second; es.EffectiveLatency() != e {
+		t.Errorf("got: %s wanted: %s", es.EffectiveLatency(), e)
+	}
+
+	es.Latency = -time.Second
+	if err := es.Start(); err == nil {
+		es.Stop()
+		t.Error("Start succeeded with a negative latency")
+	}
+}
+
+func TestEventIDsWrapped(t *testing.T) {
+	es := &EventStream{
+		Events:  make(chan []Event, 1),
+		Wrapped: make(chan uint64, 1),
+	}
+	es.deliver([]Event{{Path: "/", Flags: EventIDsWrapped, ID: 3}})
+	select {
+	case id := <-es.Wrapped:
+		if id != 3 {
+			t.Errorf("got: %d wanted: 3", id)
+		}
+	default:
+		t.Fatal("no signal on Wrapped")
+	}
+
+	// a resume point from before the wrap is past the latest event
+	es = &EventStream{Resume: true, EventID: eventIDSinceNow - 1}
+	if id := es.sinceEventID(); id != eventIDSinceNow {
+		t.Errorf("got: %d wanted: %d", id, eventIDSinceNow)
+	}
+	if es.LatestEventID() > LatestEventID() {
+		t.Errorf("stale resume point %d was kept", es.LatestEventID())
+	}
+
+	es = &EventStream{Resume: true, EventID: 1}
+	if id := es.sinceEventID(); id != 1 {
+		t.Errorf("got: %d wanted: 1", id)
+	}
+
+	// nor is a fresh one of a device stream
+	dev, err := DeviceForPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := LatestEventID()
+	es = &EventStream{Resume: true, EventID: latest, Device: dev}
+	if id := es.sinceEventID(); id != latest {
+		t.Errorf("got: %d wanted: %d", id, latest)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	missing := filepath.Join(path, "missing")
+
+	es := &EventStream{Paths: []string{path, missing, "/dev/null"}}
+	err = es.Validate()
+	perrs, ok := err.(PathsError)
+	if !ok {
+		t.Fatalf("got: %v wanted a PathsError", err)
+	}
+	if len(perrs) != 2 || perrs[0].Path != missing || perrs[1].Path != "/dev/null" {
+		t.Errorf("got: %v wanted errors for %s and /dev/null", err, missing)
+	}
+
+	es.Paths = []string{path, missing}
+	if err := es.Start(); err == nil {
+		es.Stop()
+		t.Error("Start succeeded with a missing path")
+	}
+	es.AllowMissing = true
+	if err := es.Start(); err != nil {
+		t.Fatalf("Start with AllowMissing: %v", err)
+	}
+	es.Stop()
+}
+
+func TestDone(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	es := &EventStream{
+		Paths:   []string{path},
+		Latency: 500 * time.Millisecond,
+	}
+	select {
+	case <-es.Done():
+	default:
+		t.Error("Done is open before Start")
+	}
+
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := es.Done()
+	select {
+	case <-done:
+		t.Fatal("Done is closed while running")
+	default:
+	}
+
+	es.Stop()
+	select {
+	case <-done:
+	default:
+		t.Fatal("Done is open after Stop")
+	}
+	// nothing can be sent anymore
+	close(es.Events)
+}
+
+func TestCaughtUp(t *testing.T) {
+	es := &EventStream{
+		Events:   make(chan []Event, 2),
+		caughtUp: make(chan struct{}),
+	}
+	es.deliver([]Event{{Path: "/a", Flags: ItemCreated, ID: 1}})
+	select {
+	case <-es.CaughtUp():
+		t.Fatal("caught up before HistoryDone")
+	default:
+	}
+
+	es.deliver([]Event{{Flags: HistoryDone, ID: 2}})
+	select {
+	case <-es.CaughtUp():
+	default:
+		t.Fatal("not caught up after HistoryDone")
+	}
+}
+
+func TestVolumeEvents(t *testing.T) {
+	es := &EventStream{
+		Events:       make(chan []Event, 1),
+		VolumeEvents: make(chan Event, 2),
+		Mask:         ItemCreated,
+	}
+	es.deliver([]Event{
+		{Path: "/Volumes/USB", Flags: Mount},
+		{Path: "/Volumes/a", Flags: ItemCreated},
+		{Path: "/Volumes/Old", Flags: Unmount},
+	})
+
+	if event := <-es.VolumeEvents; event.Path != "/Volumes/USB" || !event.Flags.IsMount() {
+		t.Errorf("got: %v wanted the mount of /Volumes/USB", event)
+	}
+	if event := <-es.VolumeEvents; event.Path != "/Volumes/Old" || !event.Flags.IsUnmount() {
+		t.Errorf("got: %v wanted the unmount of /Volumes/Old", event)
+	}
+	if msg := <-es.Events; len(msg) != 1 || msg[0].Path != "/Volumes/a" {
+		t.Errorf("got: %v wanted only the event for /Volumes/a", msg)
+	}
+}
+
+func TestDropOnFull(t *testing.T) {
+	es := &EventStream{
+		Events:     make(chan []Event, 1),
+		Dropped:    make(chan []string, 1),
+		DropOnFull: true,
+	}
+	es.deliver([]Event{{Path: "/a", Flags: ItemCreated}})
+	es.deliver([]Event{{Path: "/b", Flags: ItemCreated}, {Path: "/c", Flags: ItemRemoved}})
+
+	if msg := <-es.Events; len(msg) != 1 || msg[0].Path != "/a" {
+		t.Errorf("got: %v wanted the first batch", msg)
+	}
+	select {
+	case paths := <-es.Dropped:
+		if strings.Join(paths, " ") != "/b /c" {
+			t.Errorf("got: %q wanted: [/b /c]", paths)
+		}
+	default:
+		t.Fatal("the dropped batch was not signalled")
+	}
+}
+
+func TestDropOnFullSideChannels(t *testing.T) {
+	// nobody is receiving from any of them
+	es := &EventStream{
+		Events:       make(chan []Event),
+		Dropped:      make(chan []string),
+		VolumeEvents: make(chan Event),
+		Wrapped:      make(chan uint64),
+		DropOnFull:   true,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		es.deliver([]Event{
+			{Path: "/a", Flags: MustScanSubDirs},
+			{Path: "/Volumes/USB", Flags: Mount},
+			{Path: "/", Flags: EventIDsWrapped, ID: 3},
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the callback blocked on a side channel")
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	es := &EventStream{
+		Paths:      []string{path},
+		Latency:    500 * time.Millisecond,
+		BufferSize: -1,
+	}
+	if err := es.Start(); err == nil {
+		es.Stop()
+		t.Fatal("Start succeeded with a negative BufferSize")
+	}
+
+	es.BufferSize = 8
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	if c := cap(es.Events); c != es.BufferSize {
+		t.Errorf("got: %d wanted: %d", c, es.BufferSize)
+	}
+}
+
+func TestClone(t *testing.T) {
+	es := &EventStream{
+		EventID:        42,
+		Events:         make(chan []Event),
+		Dropped:        make(chan []string),
+		Paths:          []string{"/a", "/b"},
+		ExclusionPaths: []string{"/a/b"},
+		Flags:          FileEvents | WatchRoot,
+		Latency:        time.Second,
+		Device:         3,
+		Resume:         true,
+		Mask:           ItemCreated,
+	}
+
+	c := es.Clone()
+	if c.Events != nil || c.Dropped != nil {
+		t.Error("channels were copied")
+	}
+	if c.LatestEventID() != 42 || c.Flags != es.Flags || c.Latency != es.Latency ||
+		c.Device != es.Device || !c.Resume || c.Mask != es.Mask {
+		t.Errorf("got: %+v wanted the configuration of: %+v", c, es)
+	}
+
+	c.Paths[0] = "/c"
+	c.ExclusionPaths[0] = "/c/d"
+	if es.Paths[0] != "/a" || es.ExclusionPaths[0] != "/a/b" {
+		t.Error("paths are shared with the clone")
+	}
+}
+
+func TestUseCFTypes(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	es := &EventStream{
+		Paths:   []string{path},
+		Latency: 500 * time.Millisecond,
+		Flags:   FileEvents | UseCFTypes,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	name := "exämple.txt"
+	err = ioutil.WriteFile(filepath.Join(path, name), []byte("example"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-es.Events:
+			for _, event := range msg {
+				if strings.HasSuffix(event.Path, ".txt") {
+					if dir := filepath.Dir(event.Path); !strings.HasSuffix(dir, filepath.Base(path)) {
+						t.Errorf("event path %q is not in %s", event.Path, path)
+					}
+					if base := filepath.Base(event.Path); base != name {
+						t.Errorf("got: %q wanted: %q", base, name)
+					}
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for an event")
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	es := &EventStream{
+		Events: make(chan []Event, 1),
+		// stands in for norm.NFC.String
+		NormalizePath: strings.NewReplacer("e\u0301", "\u00e9").Replace,
+	}
+	// decomposed, as reported on HFS+
+	es.deliver([]Event{{Path: "/tmp/cafe\u0301.txt", Flags: ItemCreated}})
+
+	if msg := <-es.Events; msg[0].Path != "/tmp/caf\u00e9.txt" {
+		t.Errorf("got: %+q wanted: %+q", msg[0].Path, "/tmp/caf\u00e9.txt")
+	}
+}
+
+func TestLatestEventIDForDevice(t *testing.T) {
+	dev, err := DeviceForPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if LatestEventIDForDevice(dev) == 0 {
+		t.Error("no event ID for the root device")
+	}
+}
+
+func TestHandedOver(t *testing.T) {
+	es := &EventStream{
+		Events: make(chan []Event, 1),
+		Mask:   ItemCreated,
+	}
+	es.deliver([]Event{{Path: "/a", Flags: ItemCreated, ID: 10}})
+	if id := es.LatestEventID(); id != 10 {
+		t.Errorf("got: %d wanted: %d", id, 10)
+	}
+	// filtered out entirely, but deliberately so
+	es.deliver([]Event{{Path: "/b", Flags: ItemRemoved, ID: 11}})
+	if id := es.LatestEventID(); id != 11 {
+		t.Errorf("got: %d wanted: %d", id, 11)
+	}
+
+	// nor is an older ID, or the ID 0 of a batch filtered out entirely
+	es.deliver([]Event{{Path: "/d", Flags: ItemRemoved, ID: 5}})
+	es.deliver([]Event{{Path: "/d", Flags: ItemRemoved, ID: 0}})
+	if id := es.LatestEventID(); id != 11 {
+		t.Errorf("got: %d wanted: %d", id, 11)
+	}
+
+	// given up on after Stop, so it must be delivered again
+	es.quit = make(chan struct{})
+	close(es.quit)
+	es.deliver([]Event{{Path: "/c", Flags: ItemCreated, ID: 12}})
+	if id := es.LatestEventID(); id != 11 {
+		t.Errorf("got: %d wanted: %d", id, 11)
+	}
+}
+
+func TestRootChangedEventID(t *testing.T) {
+	es := &EventStream{Events: make(chan []Event, 2)}
+	es.deliver([]Event{{Path: "/a", Flags: ItemCreated, ID: 10}})
+	// RootChanged events have ID 0, resuming from which replays all history
+	es.deliver([]Event{{Path: "/", Flags: RootChanged, ID: 0}})
+	if id := es.LatestEventID(); id != 10 {
+		t.Errorf("got: %d wanted: %d", id, 10)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var got []Event
+	es := &EventStream{
+		Events:  make(chan []Event),
+		Mask:    ItemCreated,
+		Handler: func(events []Event) { got = append(got, events...) },
+	}
+	// would block on the unbuffered Events if it were used
+	es.deliver([]Event{{Path: "/a", Flags: ItemCreated}, {Path: "/b", Flags: ItemRemoved}})
+
+	if len(got) != 1 || got[0].Path != "/a" {
+		t.Errorf("got: %v wanted only the event for /a", got)
+	}
+}
+
+func TestFlushSyncStop(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	es := &EventStream{
+		Paths:   []string{path},
+		Latency: time.Minute,
+		Flags:   FileEvents,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(path, "example.txt"), []byte("example"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody receives the flushed events
+	flushed := make(chan struct{})
+	go func() {
+		es.Flush(true)
+		close(flushed)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		es.Running()
+		es.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop blocked by Flush")
+	}
+	<-flushed
+}
+
+func TestUpdatePathsRedelivers(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	added, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(added)
+
+	es := &EventStream{
+		Paths:   []string{path},
+		Latency: 100 * time.Millisecond,
+		Flags:   FileEvents,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	err = ioutil.WriteFile(filepath.Join(path, "example.txt"), []byte("example"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the callback is now waiting for the consumer, which is busy
+	time.Sleep(time.Second)
+
+	if err := es.UpdatePaths([]string{path, added}); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-es.Events:
+			for _, event := range msg {
+				if filepath.Base(event.Path) == "example.txt" {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatal("the event pending during UpdatePaths was lost")
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// +build darwin
+
+package fsevents
+
+// RenameEvent is a rename of the item at From to To.
+type RenameEvent struct {
+	From string
+	To   string
+}
+
+// itemTypes are the flags telling what kind of item an event is about.
+const itemTypes = ItemIsFile | ItemIsDir | ItemIsSymlink
+
+// PairRenames matches up the two ItemRenamed events FSEvents reports for a
+// rename, the old path followed by the new one with the next event ID, and
+// returns them as RenameEvents along with the remaining events in order.
+//
+// FSEvents doesn't link the two events, so this is a heuristic: an item
+// moved out of the watched tree only reports its old path, one moved in
+// only its new path, and the halves of a rename may be split across
+// batches. Such events are left unpaired, and should be handled by checking
+// whether the path still exists.
+func PairRenames(events []Event) ([]RenameEvent, []Event) {
+	var (
+		renames []RenameEvent
+		rest    []Event
+	)
+	for i := 0; i < len(events); i++ {
+		from := events[i]
+		if i+1 < len(events) && isRenamePair(from, events[i+1]) {
+			renames = append(renames, RenameEvent{From: from.Path, To: events[i+1].Path})
+			i++
+			continue
+		}
+		rest = append(rest, from)
+	}
+	return renames, rest
+}
+
+// isRenamePair reports whether from and to look like the old and new path
+// of the same rename.
+func isRenamePair(from, to Event) bool {
+	return from.Flags&ItemRenamed != 0 && to.Flags&ItemRenamed != 0 &&
+		to.ID == from.ID+1 && from.Flags&itemTypes == to.Flags&itemTypes
+}
@@ -0,0 +1,33 @@
+// +build darwin
+
+package fsevents
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPairRenames(t *testing.T) {
+	events := []Event{
+		{Path: "/a", Flags: ItemRenamed | ItemIsFile, ID: 10},
+		{Path: "/b", Flags: ItemRenamed | ItemIsFile, ID: 11},
+		{Path: "/c", Flags: ItemModified | ItemIsFile, ID: 12},
+		// moved out of the tree, the next rename isn't adjacent
+		{Path: "/d", Flags: ItemRenamed | ItemIsDir, ID: 13},
+		{Path: "/e", Flags: ItemRenamed | ItemIsDir, ID: 15},
+		{Path: "/f", Flags: ItemRenamed | ItemIsDir, ID: 16},
+		// the new path is in the next batch
+		{Path: "/g", Flags: ItemRenamed | ItemIsFile, ID: 17},
+	}
+
+	renames, rest := PairRenames(events)
+
+	wantRenames := []RenameEvent{{From: "/a", To: "/b"}, {From: "/e", To: "/f"}}
+	if !reflect.DeepEqual(renames, wantRenames) {
+		t.Errorf("got: %v wanted: %v", renames, wantRenames)
+	}
+	wantRest := []Event{events[2], events[3], events[6]}
+	if !reflect.DeepEqual(rest, wantRest) {
+		t.Errorf("got: %v wanted: %v", rest, wantRest)
+	}
+}
@@ -0,0 +1,179 @@
+// +build darwin
+
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	// ErrNonExistentWatch is returned by Watcher.Remove for a path that
+	// isn't being watched.
+	ErrNonExistentWatch = errors.New("fsevents: can't remove non-existent watch")
+
+	// ErrWatcherClosed is returned when adding or removing paths on a
+	// closed Watcher.
+	ErrWatcherClosed = errors.New("fsevents: watcher closed")
+)
+
+// RescanError is sent on Watcher.Errors when FSEvents dropped events, and
+// the directories at Paths have to be rescanned.
+type RescanError struct {
+	Paths []string
+}
+
+func (e *RescanError) Error() string {
+	return fmt.Sprintf("fsevents: events dropped, rescan %q", e.Paths)
+}
+
+// Watcher watches a changing set of paths, with an API similar to fsnotify.
+// It is built on an EventStream with FileEvents, which is replaced whenever
+// paths are added or removed, resuming from the last event seen. Use
+// EventStream directly for more control.
+//
+//   w, _ := NewWatcher()
+//   w.Add("/tmp")
+//   for event := range w.Events {
+//       ...
+//   }
+type Watcher struct {
+	Events <-chan Event
+	Errors <-chan error
+
+	mu     sync.Mutex // guards the fields below and the stream
+	es     *EventStream
+	paths  []string
+	closed bool
+
+	events chan Event
+	errors chan error
+	done   chan struct{} // closed by Close
+}
+
+// NewWatcher returns a Watcher that isn't watching any paths yet.
+// The error is always nil, and is there for compatibility with fsnotify.
+func NewWatcher() (*Watcher, error) {
+	events := make(chan Event)
+	errs := make(chan error)
+	w := &Watcher{
+		Events: events,
+		Errors: errs,
+		es: &EventStream{
+			Events:  make(chan []Event),
+			Dropped: make(chan []string),
+			Flags:   FileEvents,
+		},
+		events: events,
+		errors: errs,
+		done:   make(chan struct{}),
+	}
+	go w.forward()
+	return w, nil
+}
+
+// forward passes events and errors from the stream on to the Watcher's
+// channels, closing them once the Watcher is closed.
+func (w *Watcher) forward() {
+	defer close(w.errors)
+	defer close(w.events)
+
+	for {
+		select {
+		case batch := <-w.es.Events:
+			for _, event := range batch {
+				select {
+				case w.events <- event:
+				case <-w.done:
+					return
+				}
+			}
+		case paths := <-w.es.Dropped:
+			select {
+			case w.errors <- &RescanError{Paths: paths}:
+			case <-w.done:
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Add starts watching path, which is watched recursively. Adding a path
+// that is already watched does nothing.
+func (w *Watcher) Add(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrWatcherClosed
+	}
+	path = filepath.Clean(path)
+	for _, p := range w.paths {
+		if p == path {
+			return nil
+		}
+	}
+
+	paths := make([]string, len(w.paths), len(w.paths)+1)
+	copy(paths, w.paths)
+	return w.setPaths(append(paths, path))
+}
+
+// Remove stops watching path. It returns ErrNonExistentWatch if path was
+// never added.
+func (w *Watcher) Remove(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrWatcherClosed
+	}
+	path = filepath.Clean(path)
+	for i, p := range w.paths {
+		if p == path {
+			paths := make([]string, 0, len(w.paths)-1)
+			paths = append(paths, w.paths[:i]...)
+			return w.setPaths(append(paths, w.paths[i+1:]...))
+		}
+	}
+	return ErrNonExistentWatch
+}
+
+// setPaths points the stream at paths, stopping it when there are none.
+func (w *Watcher) setPaths(paths []string) error {
+	var err error
+	switch {
+	case len(paths) == 0:
+		w.es.Stop()
+	case w.es.Running():
+		err = w.es.UpdatePaths(paths)
+	default:
+		// nothing was watched in between, so don't replay it
+		w.es.Paths = paths
+		w.es.Resume = false
+		err = w.es.Start()
+	}
+
+	if err == nil {
+		w.paths = paths
+	}
+	return err
+}
+
+// Close stops watching all paths, and closes Events and Errors.
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	w.es.Stop()
+	return nil
+}
@@ -0,0 +1,60 @@
+// +build darwin
+
+package fsevents
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	path, err := ioutil.TempDir("", "fsexample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(path); err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(path, "example.txt"), []byte("example"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for received := false; !received; {
+		select {
+		case event := <-w.Events:
+			received = filepath.Base(event.Path) == "example.txt"
+		case err := <-w.Errors:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatal("timed out waiting for an event")
+		}
+	}
+
+	if err := w.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Remove(path); err != ErrNonExistentWatch {
+		t.Errorf("second Remove got: %v wanted: %v", err, ErrNonExistentWatch)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range w.Events {
+	}
+	if err := w.Add(path); err != ErrWatcherClosed {
+		t.Errorf("Add after Close got: %v wanted: %v", err, ErrWatcherClosed)
+	}
+}
@@ -6,6 +6,7 @@ package fsevents
 #cgo LDFLAGS: -framework CoreServices
 #include <CoreServices/CoreServices.h>
 #include <sys/stat.h>
+#include <dispatch/dispatch.h>
 
 static CFArrayRef ArrayCreateMutable(int len) {
 	return CFArrayCreateMutable(NULL, len, &kCFTypeArrayCallBacks);
@@ -22,6 +23,20 @@ static FSEventStreamRef EventStreamCreate(FSEventStreamContext * context, uintpt
 	context->info = (void*) info;
 	return FSEventStreamCreate(NULL, (FSEventStreamCallback) fsevtCallbackMutagen, context, paths, since, latency, flags);
 }
+
+static dispatch_queue_t DispatchQueueCreate(void) {
+	return dispatch_queue_create("fsevents", DISPATCH_QUEUE_SERIAL);
+}
+
+static void dispatchNoop(void *context) {}
+
+static void DispatchQueueDrain(dispatch_queue_t queue) {
+	dispatch_sync_f(queue, NULL, dispatchNoop);
+}
+
+static void DispatchQueueRelease(dispatch_queue_t queue) {
+	dispatch_release(queue);
+}
 */
 import "C"
 import (
@@ -48,28 +63,39 @@ func LatestEventID() uint64 {
 //export fsevtCallbackMutagen
 func fsevtCallbackMutagen(stream C.FSEventStreamRef, info uintptr, numEvents C.size_t, cpaths **C.char, cflags *C.FSEventStreamEventFlags, cids *C.FSEventStreamEventId) {
 	l := int(numEvents)
-	events := make([]Event, l)
 
 	es := registry.Get(info)
 	if es == nil {
 		log.Printf("failed to retrieve registry %d", info)
 		return
 	}
+	events := es.newBatch(l)
 	// These slices are backed by C data. Ensure data is copied out
 	// if it expected to exist outside of this function.
-	paths := (*[1 << 30]*C.char)(unsafe.Pointer(cpaths))[:l:l]
 	ids := (*[1 << 30]C.FSEventStreamEventId)(unsafe.Pointer(cids))[:l:l]
 	flags := (*[1 << 30]C.FSEventStreamEventFlags)(unsafe.Pointer(cflags))[:l:l]
 	for i := range events {
 		events[i] = Event{
-			Path:  C.GoString(paths[i]),
 			Flags: EventFlags(flags[i]),
 			ID:    uint64(ids[i]),
 		}
-		es.EventID = uint64(ids[i])
 	}
 
-	es.Events <- events
+	// Flags may have changed since, but not how this stream passes paths
+	if es.flags&UseCFTypes != 0 {
+		// the paths are a CFArray of CFStrings rather than C strings
+		arr := C.CFArrayRef(unsafe.Pointer(cpaths))
+		for i := range events {
+			events[i].Path = cfStringToGoString(C.CFStringRef(C.CFArrayGetValueAtIndex(arr, C.CFIndex(i))))
+		}
+	} else {
+		paths := (*[1 << 30]*C.char)(unsafe.Pointer(cpaths))[:l:l]
+		for i := range events {
+			events[i].Path = C.GoString(paths[i])
+		}
+	}
+
+	es.deliver(events)
 }
 
 // FSEventStreamRef wraps C.FSEventStreamRef
@@ -95,6 +121,7 @@ func GetStreamRefDescription(f FSEventStreamRef) string {
 // this stream
 func GetStreamRefPaths(f FSEventStreamRef) []string {
 	arr := C.FSEventStreamCopyPathsBeingWatched(f)
+	defer C.CFRelease(C.CFTypeRef(arr))
 	l := cfArrayLen(arr)
 
 	ss := make([]string, l)
@@ -112,7 +139,11 @@ func GetDeviceUUID(deviceID int32) string {
 	if uuid == C.CFUUIDRef(0) {
 		return ""
 	}
-	return cfStringToGoString(C.CFUUIDCreateString(C.kCFAllocatorDefault, uuid))
+	defer C.CFRelease(C.CFTypeRef(uuid))
+
+	str := C.CFUUIDCreateString(C.kCFAllocatorDefault, uuid)
+	defer C.CFRelease(C.CFTypeRef(str))
+	return cfStringToGoString(str)
 }
 
 func cfStringToGoString(cfs C.CFStringRef) string {
@@ -120,6 +151,7 @@ func cfStringToGoString(cfs C.CFStringRef) string {
 		return ""
 	}
 	cfStr := C.CFStringCreateCopy(C.kCFAllocatorDefault, cfs)
+	defer C.CFRelease(C.CFTypeRef(cfStr))
 	length := C.CFStringGetLength(cfStr)
 	if length == 0 {
 		// short-cut for empty strings
@@ -151,9 +183,14 @@ func cfStringToGoString(cfs C.CFStringRef) string {
 // CFRunLoopRef wraps C.CFRunLoopRef
 type CFRunLoopRef C.CFRunLoopRef
 
-// EventIDForDeviceBeforeTime returns an event ID before a given time.
+// dispatchQueue wraps C.dispatch_queue_t
+type dispatchQueue C.dispatch_queue_t
+
+// EventIDForDeviceBeforeTime returns the last event ID for a device before
+// a given time, which makes a resume point for e.g. "10 minutes ago".
+// Pass dev 0 for a host event ID.
 func EventIDForDeviceBeforeTime(dev int32, before time.Time) uint64 {
-	tm := C.CFAbsoluteTime(before.Unix())
+	tm := C.CFAbsoluteTime(cfAbsoluteTime(before))
 	return uint64(C.FSEventsGetLastEventIdForDeviceBeforeTime(C.dev_t(dev), tm))
 }
 
@@ -174,6 +211,8 @@ func createPaths(paths []string) (C.CFArrayRef, error) {
 
 		str := C.CFStringCreateWithCString(C.kCFAllocatorDefault, cpath, C.kCFStringEncodingUTF8)
 		C.CFArrayAppendValue(C.CFMutableArrayRef(cPaths), unsafe.Pointer(str))
+		// the array holds its own reference
+		C.CFRelease(C.CFTypeRef(str))
 	}
 	var err error
 	if len(errs) > 0 {
@@ -215,35 +254,108 @@ func setupStream(paths []string, flags CreateFlags, callbackInfo uintptr, eventI
 	return FSEventStreamRef(ref)
 }
 
-func (es *EventStream) start(paths []string, callbackInfo uintptr) {
+// setExclusionPaths asks the stream to ignore events under paths. It must be
+// called before the stream is scheduled. Requires macOS 10.9+.
+func setExclusionPaths(stream FSEventStreamRef, paths []string) error {
+	cPaths, err := createPaths(paths)
+	if err != nil {
+		log.Printf("Error creating exclusion paths: %s", err)
+	}
+	defer C.CFRelease(C.CFTypeRef(cPaths))
+
+	if C.FSEventStreamSetExclusionPaths(stream, cPaths) == 0 {
+		return fmt.Errorf("fsevents: failed to set exclusion paths %q", paths)
+	}
+	return nil
+}
+
+func (es *EventStream) start(paths []string, callbackInfo uintptr) error {
+
+	es.flags = es.Flags
+	es.stream = setupStream(paths, es.flags, callbackInfo, es.sinceEventID(), es.EffectiveLatency(), es.Device)
+	if es.stream == nil {
+		return ErrCreateFailed
+	}
+
+	if len(es.ExclusionPaths) > 0 {
+		if err := setExclusionPaths(es.stream, es.ExclusionPaths); err != nil {
+			C.FSEventStreamRelease(es.stream)
+			es.stream = nil
+			return err
+		}
+	}
+
+	es.quit = make(chan struct{})
+	es.done = make(chan struct{})
+
+	var err error
+	if es.UseDispatchQueue {
+		err = es.startQueue()
+	} else {
+		err = es.startRunLoop()
+	}
+	if err != nil {
+		return err
+	}
 
-	since := eventIDSinceNow
-	if es.Resume {
-		since = es.EventID
+	if !es.hasFinalizer {
+		// TODO: There is no guarantee this run before program exit
+		// and could result in panics at exit.
+		runtime.SetFinalizer(es, finalizer)
+		es.hasFinalizer = true
 	}
 
-	es.stream = setupStream(paths, es.Flags, callbackInfo, since, es.Latency, es.Device)
+	return nil
+}
 
-	started := make(chan struct{})
+// startRunLoop schedules the stream on the run loop of a dedicated,
+// locked OS thread.
+func (es *EventStream) startRunLoop() error {
+	started := make(chan bool)
+	done := es.done
 
 	go func() {
 		runtime.LockOSThread()
 		es.rlref = CFRunLoopRef(C.CFRunLoopGetCurrent())
 		C.CFRetain(C.CFTypeRef(es.rlref))
 		C.FSEventStreamScheduleWithRunLoop(es.stream, C.CFRunLoopRef(es.rlref), C.kCFRunLoopDefaultMode)
-		C.FSEventStreamStart(es.stream)
-		close(started)
-		C.CFRunLoopRun()
+		ok := C.FSEventStreamStart(es.stream) != 0
+		started <- ok
+		if ok {
+			C.CFRunLoopRun()
+		}
+		close(done)
 	}()
 
-	if !es.hasFinalizer {
-		// TODO: There is no guarantee this run before program exit
-		// and could result in panics at exit.
-		runtime.SetFinalizer(es, finalizer)
-		es.hasFinalizer = true
+	if !<-started {
+		// The run loop was never entered, so there is nothing to stop.
+		C.FSEventStreamInvalidate(es.stream)
+		C.FSEventStreamRelease(es.stream)
+		C.CFRelease(C.CFTypeRef(es.rlref))
+		es.stream = nil
+		return ErrStartFailed
 	}
+	return nil
+}
 
-	<-started
+// startQueue schedules the stream on a serial dispatch queue, so no
+// goroutine has to be dedicated to a run loop (macOS 10.6+).
+func (es *EventStream) startQueue() error {
+	es.queue = dispatchQueue(C.DispatchQueueCreate())
+	C.FSEventStreamSetDispatchQueue(es.stream, C.dispatch_queue_t(es.queue))
+
+	if C.FSEventStreamStart(es.stream) == 0 {
+		C.FSEventStreamSetDispatchQueue(es.stream, nil)
+		C.FSEventStreamInvalidate(es.stream)
+		C.FSEventStreamRelease(es.stream)
+		C.DispatchQueueRelease(C.dispatch_queue_t(es.queue))
+		es.stream = nil
+		es.queue = nil
+		// nothing is running, as Done should tell
+		close(es.done)
+		return ErrStartFailed
+	}
+	return nil
 }
 
 func finalizer(es *EventStream) {
@@ -252,13 +364,14 @@ func finalizer(es *EventStream) {
 	es.Stop()
 }
 
-// flush drains the event stream of undelivered events
-func flush(stream FSEventStreamRef, sync bool) {
+// flush drains the event stream of undelivered events, returning the ID of
+// the last event flushed
+func flush(stream FSEventStreamRef, sync bool) uint64 {
 	if sync {
 		C.FSEventStreamFlushSync(stream)
-	} else {
-		C.FSEventStreamFlushAsync(stream)
+		return uint64(C.FSEventStreamGetLatestEventId(stream))
 	}
+	return uint64(C.FSEventStreamFlushAsync(stream))
 }
 
 // stop requests fsevents stops streaming events
@@ -269,3 +382,14 @@ func stop(stream FSEventStreamRef, rlref CFRunLoopRef) {
 	C.CFRunLoopStop(C.CFRunLoopRef(rlref))
 	C.CFRelease(C.CFTypeRef(rlref))
 }
+
+// stopQueue is stop for a stream scheduled on a dispatch queue. It returns
+// once any callback in flight on the queue has finished.
+func stopQueue(stream FSEventStreamRef, queue dispatchQueue) {
+	C.FSEventStreamStop(stream)
+	C.DispatchQueueDrain(C.dispatch_queue_t(queue))
+	C.FSEventStreamSetDispatchQueue(stream, nil)
+	C.FSEventStreamInvalidate(stream)
+	C.FSEventStreamRelease(stream)
+	C.DispatchQueueRelease(C.dispatch_queue_t(queue))
+}
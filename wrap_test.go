@@ -53,3 +53,11 @@ func TestDeviceID(t *testing.T) {
 		t.Fatal("failed to read device ID")
 	}
 }
+
+func TestEventIDForDeviceBeforeTime(t *testing.T) {
+	latest := LatestEventID()
+	past := EventIDForDeviceBeforeTime(0, time.Now().Add(-time.Hour))
+	if past > latest {
+		t.Errorf("event ID an hour ago %d is after the latest event ID %d", past, latest)
+	}
+}